@@ -173,8 +173,20 @@ WHERE file_id = ?1`
 	return readFileTags(rows, make(entities.FileTags, 0, 10))
 }
 
-// Retrieves the set of file tags matching the specified query.
+// Retrieves the set of file tags matching the specified query, consulting
+// the query cache before running the underlying SQL.
 func FileTagsForQuery(tx *Tx, expression query.Expression) (entities.TagValuePairs, error) {
+	key := hashExpression(expression)
+
+	if pairs, tagIds, valueIds, found, err := fileTagQueryCache.get(tx, key); err != nil {
+		return nil, err
+	} else if found {
+		if err := bumpFileTagUsage(tx, tagIds, valueIds); err != nil {
+			return nil, err
+		}
+		return pairs, nil
+	}
+
 	builder := buildFileTagsQuery(expression)
 
 	rows, err := tx.Query(builder.Sql(), builder.Params()...)
@@ -183,7 +195,25 @@ func FileTagsForQuery(tx *Tx, expression query.Expression) (entities.TagValuePai
 	}
 	defer rows.Close()
 
-	return readTagValuePairs(rows, make(entities.TagValuePairs, 0, 10))
+	pairs, err := readTagValuePairs(rows, make(entities.TagValuePairs, 0, 10))
+	if err != nil {
+		return nil, err
+	}
+
+	tagIds, valueIds, err := dependencies(tx, expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fileTagQueryCache.put(tx, key, pairs, tagIds, valueIds); err != nil {
+		return nil, err
+	}
+
+	if err := bumpFileTagUsage(tx, tagIds, valueIds); err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
 }
 
 // Adds a file tag.
@@ -197,6 +227,10 @@ VALUES (?1, ?2, ?3)`
 		return nil, err
 	}
 
+	if err := invalidateFileTagCache(tx, tagId, valueId); err != nil {
+		return nil, err
+	}
+
 	return &entities.FileTag{fileId, tagId, valueId, true, false}, nil
 }
 
@@ -222,23 +256,73 @@ WHERE file_id = ?1 AND tag_id = ?2 AND value_id = ?3`
 		panic("expected only one row to be affected.")
 	}
 
-	return nil
+	return invalidateFileTagCache(tx, tagId, valueId)
 }
 
 // Removes all of the file tags for the specified file.
 func DeleteFileTagsByFileId(tx *Tx, fileId entities.FileId) error {
+	pairs, err := distinctTagValuePairsByFileId(tx, fileId)
+	if err != nil {
+		return err
+	}
+
 	sql := `
 DELETE FROM file_tag
 WHERE file_id = ?`
 
-	_, err := tx.Exec(sql, fileId)
-	if err != nil {
+	if _, err := tx.Exec(sql, fileId); err != nil {
 		return err
 	}
 
+	for _, pair := range pairs {
+		if err := invalidateFileTagCache(tx, pair.tagId, pair.valueId); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+type tagValueIdPair struct {
+	tagId   entities.TagId
+	valueId entities.ValueId
+}
+
+// distinctTagValuePairsByFileId looks up the distinct tag/value combinations
+// tagged on the specified file, before they are deleted, so that the cache
+// entries depending on them can be invalidated afterwards: there is no
+// reverse index from file to cache entry, so this has to be done by dependency
+// rather than by file.
+func distinctTagValuePairsByFileId(tx *Tx, fileId entities.FileId) ([]tagValueIdPair, error) {
+	sql := `
+SELECT DISTINCT tag_id, value_id
+FROM file_tag
+WHERE file_id = ?`
+
+	rows, err := tx.Query(sql, fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pairs := make([]tagValueIdPair, 0, 10)
+
+	for rows.Next() {
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+
+		var pair tagValueIdPair
+		if err := rows.Scan(&pair.tagId, &pair.valueId); err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, pair)
+	}
+
+	return pairs, nil
+}
+
 // Removes all of the file tags for the specified tag.
 func DeleteFileTagsByTagId(tx *Tx, tagId entities.TagId) error {
 	sql := `
@@ -250,7 +334,11 @@ WHERE tag_id = ?`
 		return err
 	}
 
-	return nil
+	if err := deleteFileTagUsageByTagId(tx, tagId); err != nil {
+		return err
+	}
+
+	return fileTagQueryCache.invalidateTag(tx, tagId)
 }
 
 // Removes all of the file tags for the specified value.
@@ -264,7 +352,11 @@ WHERE value_id = ?`
 		return err
 	}
 
-	return nil
+	if err := deleteFileTagUsageByValueId(tx, valueId); err != nil {
+		return err
+	}
+
+	return fileTagQueryCache.invalidateValue(tx, valueId)
 }
 
 // Copies file tags from one tag to another.
@@ -280,7 +372,7 @@ WHERE tag_id = ?1`
 		return err
 	}
 
-	return nil
+	return fileTagQueryCache.invalidateTag(tx, destTagId)
 }
 
 // helpers
@@ -351,6 +443,10 @@ func buildFileTagsQueryBranch(expression query.Expression, builder *SqlBuilder)
 		buildFileTagAllValuesQueryBranch(exp, builder)
 	case query.AndExpression:
 		buildFileTagAndQueryBranch(exp, builder)
+	case query.OrExpression:
+		buildFileTagOrQueryBranch(exp, builder)
+	case query.NotExpression:
+		buildFileTagNotQueryBranch(exp, builder)
 	case query.EmptyExpression:
 		builder.AppendSql("1 == 1")
 	default:
@@ -447,7 +543,23 @@ file_id IN (WITH RECURSIVE impft (tag_id, value_id) AS
 }
 
 func buildFileTagAndQueryBranch(expression query.AndExpression, builder *SqlBuilder) {
+	builder.AppendSql("(")
 	buildFileTagsQueryBranch(expression.LeftOperand, builder)
-	builder.AppendSql("AND")
+	builder.AppendSql(") AND (")
 	buildFileTagsQueryBranch(expression.RightOperand, builder)
+	builder.AppendSql(")")
+}
+
+func buildFileTagOrQueryBranch(expression query.OrExpression, builder *SqlBuilder) {
+	builder.AppendSql("(")
+	buildFileTagsQueryBranch(expression.LeftOperand, builder)
+	builder.AppendSql(") OR (")
+	buildFileTagsQueryBranch(expression.RightOperand, builder)
+	builder.AppendSql(")")
+}
+
+func buildFileTagNotQueryBranch(expression query.NotExpression, builder *SqlBuilder) {
+	builder.AppendSql("NOT (")
+	buildFileTagsQueryBranch(expression.Operand, builder)
+	builder.AppendSql(")")
 }
@@ -0,0 +1,126 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"github.com/oniony/TMSU/query"
+	"strings"
+	"testing"
+)
+
+func TestBuildFileTagsQueryBranchOr(t *testing.T) {
+	// a or b
+	expression := query.OrExpression{
+		LeftOperand:  query.TagExpression{Name: "a"},
+		RightOperand: query.TagExpression{Name: "b"},
+	}
+
+	builder := NewBuilder()
+	buildFileTagsQueryBranch(expression, builder)
+
+	sql := builder.Sql()
+	if !strings.Contains(sql, ") OR (") {
+		t.Errorf("expected an OR branch, got: %s", sql)
+	}
+
+	params := builder.Params()
+	if len(params) != 2 || params[0] != "a" || params[1] != "b" {
+		t.Errorf("expected params [a b], got: %v", params)
+	}
+}
+
+func TestBuildFileTagsQueryBranchNot(t *testing.T) {
+	// not a
+	expression := query.NotExpression{Operand: query.TagExpression{Name: "a"}}
+
+	builder := NewBuilder()
+	buildFileTagsQueryBranch(expression, builder)
+
+	sql := builder.Sql()
+	if !strings.Contains(sql, "NOT (") {
+		t.Errorf("expected a NOT branch, got: %s", sql)
+	}
+	if !strings.Contains(sql, "file_id IN (SELECT file_id") {
+		t.Errorf("expected NOT to wrap the implication-closure subquery rather than negate a bare row, got: %s", sql)
+	}
+
+	params := builder.Params()
+	if len(params) != 1 || params[0] != "a" {
+		t.Errorf("expected params [a], got: %v", params)
+	}
+}
+
+func TestBuildFileTagsQueryBranchAnd(t *testing.T) {
+	// a and b
+	expression := query.AndExpression{
+		LeftOperand:  query.TagExpression{Name: "a"},
+		RightOperand: query.TagExpression{Name: "b"},
+	}
+
+	builder := NewBuilder()
+	buildFileTagsQueryBranch(expression, builder)
+
+	sql := builder.Sql()
+	if !strings.Contains(sql, ") AND (") {
+		t.Errorf("expected both AND operands to be individually parenthesised, got: %s", sql)
+	}
+
+	params := builder.Params()
+	if len(params) != 2 || params[0] != "a" || params[1] != "b" {
+		t.Errorf("expected params [a b], got: %v", params)
+	}
+}
+
+// TestBuildFileTagsQueryBranchAndOrNotPrecedence asserts the exact grouping
+// produced for 'a and (b or not c)', not merely that the substrings "AND",
+// ") OR (" and "NOT (" appear somewhere — that weaker check would still pass
+// for the ungrouped 'A AND (B) OR (NOT (C))', which SQL parses as
+// '(A AND B) OR (NOT C)' rather than the intended 'A AND (B OR NOT C)'.
+func TestBuildFileTagsQueryBranchAndOrNotPrecedence(t *testing.T) {
+	// a and (b or not c)
+	left := query.TagExpression{Name: "a"}
+	right := query.OrExpression{
+		LeftOperand:  query.TagExpression{Name: "b"},
+		RightOperand: query.NotExpression{Operand: query.TagExpression{Name: "c"}},
+	}
+	expression := query.AndExpression{LeftOperand: left, RightOperand: right}
+
+	// The operands are rendered into one builder, in order, so that their
+	// parameter numbering runs on across both sides exactly as it does when
+	// the whole expression is built.
+	expectedBuilder := NewBuilder()
+	expectedBuilder.AppendSql("(")
+	buildFileTagsQueryBranch(left, expectedBuilder)
+	expectedBuilder.AppendSql(") AND (")
+	buildFileTagsQueryBranch(right, expectedBuilder)
+	expectedBuilder.AppendSql(")")
+
+	builder := NewBuilder()
+	buildFileTagsQueryBranch(expression, builder)
+
+	// Each AND operand must be wrapped in its own parens, exactly as Or and
+	// Not wrap theirs, so that an Or/Not nested inside one operand can never
+	// bind outside the AND.
+	expectedSql := expectedBuilder.Sql()
+	if builder.Sql() != expectedSql {
+		t.Errorf("AND did not parenthesise its operands correctly:\nexpected: %s\ngot:      %s", expectedSql, builder.Sql())
+	}
+
+	params := builder.Params()
+	if len(params) != 3 || params[0] != "a" || params[1] != "b" || params[2] != "c" {
+		t.Errorf("expected params [a b c], got: %v", params)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"github.com/oniony/TMSU/entities"
+	"strings"
+)
+
+// sqliteMaxHostParams is SQLite's default limit on the number of bound
+// parameters in a single statement. Batches are chunked to stay under it.
+const sqliteMaxHostParams = 999
+
+// FileTagTriple identifies a (file, tag, value) combination to be applied or
+// removed in bulk.
+type FileTagTriple struct {
+	FileId  entities.FileId
+	TagId   entities.TagId
+	ValueId entities.ValueId
+}
+
+// Adds a set of file tags in as few statements as possible, chunking to stay
+// within SQLite's host-parameter limit.
+func AddFileTags(tx *Tx, triples []FileTagTriple) ([]*entities.FileTag, error) {
+	fileTags := make([]*entities.FileTag, 0, len(triples))
+
+	const paramsPerRow = 3
+	chunkSize := sqliteMaxHostParams / paramsPerRow
+
+	for offset := 0; offset < len(triples); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(triples) {
+			end = len(triples)
+		}
+		chunk := triples[offset:end]
+
+		placeholders := make([]string, len(chunk))
+		params := make([]interface{}, 0, len(chunk)*paramsPerRow)
+		for index, triple := range chunk {
+			placeholders[index] = "(?,?,?)"
+			params = append(params, triple.FileId, triple.TagId, triple.ValueId)
+		}
+
+		sql := `
+INSERT OR IGNORE INTO file_tag (file_id, tag_id, value_id)
+VALUES ` + strings.Join(placeholders, ",")
+
+		if _, err := tx.Exec(sql, params...); err != nil {
+			return nil, err
+		}
+
+		for _, triple := range chunk {
+			if err := invalidateFileTagCache(tx, triple.TagId, triple.ValueId); err != nil {
+				return nil, err
+			}
+
+			fileTags = append(fileTags, &entities.FileTag{triple.FileId, triple.TagId, triple.ValueId, true, false})
+		}
+	}
+
+	return fileTags, nil
+}
+
+// Removes a set of file tags in as few statements as possible, chunking to
+// stay within SQLite's host-parameter limit. Triples with no matching row
+// are reported back rather than causing the whole batch to fail.
+func DeleteFileTags(tx *Tx, triples []FileTagTriple) ([]FileTagTriple, error) {
+	notFound := make([]FileTagTriple, 0)
+
+	const paramsPerRow = 3
+	chunkSize := sqliteMaxHostParams / paramsPerRow
+
+	for offset := 0; offset < len(triples); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(triples) {
+			end = len(triples)
+		}
+		chunk := triples[offset:end]
+
+		placeholders := make([]string, len(chunk))
+		params := make([]interface{}, 0, len(chunk)*paramsPerRow)
+		for index, triple := range chunk {
+			placeholders[index] = "(?,?,?)"
+			params = append(params, triple.FileId, triple.TagId, triple.ValueId)
+		}
+
+		valuesList := strings.Join(placeholders, ",")
+
+		// A single batched existence check, rather than one 'FileTagExists'
+		// call per triple; which triples are actually present has to be
+		// known before the delete runs, since the rows it removes and the
+		// rows that were never there look identical afterwards.
+		existingSql := `
+SELECT file_id, tag_id, value_id
+FROM file_tag
+WHERE (file_id, tag_id, value_id) IN (VALUES ` + valuesList + `)`
+
+		rows, err := tx.Query(existingSql, params...)
+		if err != nil {
+			return nil, err
+		}
+
+		existing := make(map[FileTagTriple]struct{}, len(chunk))
+		for rows.Next() {
+			if rows.Err() != nil {
+				rows.Close()
+				return nil, rows.Err()
+			}
+
+			var triple FileTagTriple
+			if err := rows.Scan(&triple.FileId, &triple.TagId, &triple.ValueId); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			existing[triple] = struct{}{}
+		}
+		rows.Close()
+
+		for _, triple := range chunk {
+			if _, ok := existing[triple]; !ok {
+				notFound = append(notFound, triple)
+			}
+		}
+
+		// Deleting the whole chunk is safe even though some triples are
+		// absent: removing a non-existent row is a no-op.
+		deleteSql := `
+DELETE FROM file_tag
+WHERE (file_id, tag_id, value_id) IN (VALUES ` + valuesList + `)`
+
+		if _, err := tx.Exec(deleteSql, params...); err != nil {
+			return nil, err
+		}
+
+		for triple := range existing {
+			if err := invalidateFileTagCache(tx, triple.TagId, triple.ValueId); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return notFound, nil
+}
@@ -0,0 +1,344 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/oniony/TMSU/entities"
+	"github.com/oniony/TMSU/query"
+)
+
+// QueryCacheMaxEntries is the default number of query results held in memory
+// by the file-tag query cache before the oldest entries are evicted. Rows
+// persisted to the 'query_cache' table are not evicted, and 'get' loads them
+// back into memory on an in-memory miss.
+const QueryCacheMaxEntries = 1000
+
+// NoCache disables the file-tag query cache entirely when set, forcing every
+// call to 'FileTagsForQuery' to hit the database.
+var NoCache = false
+
+// queryCacheEntry is a single cached query result together with the tag and
+// value identifiers it depends upon, so that it can be invalidated precisely
+// when one of those identifiers is touched by a mutation.
+type queryCacheEntry struct {
+	key      string
+	pairs    entities.TagValuePairs
+	tagIds   map[entities.TagId]struct{}
+	valueIds map[entities.ValueId]struct{}
+}
+
+// queryCache caches the results of 'FileTagsForQuery' keyed by a hash of the
+// query expression, invalidating entries whose tag or value dependencies
+// intersect with a mutation via reverse indexes.
+type queryCache struct {
+	maxEntries int
+	entries    map[string]*queryCacheEntry
+	order      []string
+	byTagId    map[entities.TagId]map[string]struct{}
+	byValueId  map[entities.ValueId]map[string]struct{}
+}
+
+func newQueryCache(maxEntries int) *queryCache {
+	return &queryCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*queryCacheEntry),
+		byTagId:    make(map[entities.TagId]map[string]struct{}),
+		byValueId:  make(map[entities.ValueId]map[string]struct{}),
+	}
+}
+
+// fileTagQueryCache is the process-wide cache consulted by 'FileTagsForQuery'.
+// It is backed by the 'query_cache' table so that results survive across CLI
+// invocations.
+var fileTagQueryCache = newQueryCache(QueryCacheMaxEntries)
+
+// hashExpression derives a stable cache key for a query expression.
+func hashExpression(expression query.Expression) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", expression)))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cached pairs for the expression, along with the tag and
+// value dependencies they were stored with, if present.
+func (c *queryCache) get(tx *Tx, key string) (entities.TagValuePairs, map[entities.TagId]struct{}, map[entities.ValueId]struct{}, bool, error) {
+	if NoCache {
+		return nil, nil, nil, false, nil
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		return entry.pairs, entry.tagIds, entry.valueIds, true, nil
+	}
+
+	row, ok, err := readQueryCacheRow(tx, key)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	if !ok {
+		return nil, nil, nil, false, nil
+	}
+
+	c.store(key, row.pairs, row.tagIds, row.valueIds)
+
+	return row.pairs, row.tagIds, row.valueIds, true, nil
+}
+
+// put records a query result and its dependencies in the cache, persisting it
+// to the sidecar table so that it is available to later invocations.
+func (c *queryCache) put(tx *Tx, key string, pairs entities.TagValuePairs, tagIds map[entities.TagId]struct{}, valueIds map[entities.ValueId]struct{}) error {
+	if NoCache {
+		return nil
+	}
+
+	c.store(key, pairs, tagIds, valueIds)
+
+	return writeQueryCacheRow(tx, key, pairs, tagIds, valueIds)
+}
+
+func (c *queryCache) store(key string, pairs entities.TagValuePairs, tagIds map[entities.TagId]struct{}, valueIds map[entities.ValueId]struct{}) {
+	if _, exists := c.entries[key]; !exists {
+		c.order = append(c.order, key)
+	}
+
+	c.entries[key] = &queryCacheEntry{key, pairs, tagIds, valueIds}
+
+	for tagId := range tagIds {
+		keys, ok := c.byTagId[tagId]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.byTagId[tagId] = keys
+		}
+		keys[key] = struct{}{}
+	}
+
+	for valueId := range valueIds {
+		keys, ok := c.byValueId[valueId]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.byValueId[valueId] = keys
+		}
+		keys[key] = struct{}{}
+	}
+
+	c.evictOverflow()
+}
+
+func (c *queryCache) evictOverflow() {
+	for len(c.order) > c.maxEntries {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.remove(oldest)
+	}
+}
+
+func (c *queryCache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(c.entries, key)
+
+	for index, orderedKey := range c.order {
+		if orderedKey == key {
+			c.order = append(c.order[:index], c.order[index+1:]...)
+			break
+		}
+	}
+
+	for tagId := range entry.tagIds {
+		delete(c.byTagId[tagId], key)
+	}
+	for valueId := range entry.valueIds {
+		delete(c.byValueId[valueId], key)
+	}
+}
+
+// invalidateTag drops every cached entry that depends on the specified tag.
+//
+// The affected keys are looked up from the 'query_cache_tags' reverse-index
+// table rather than 'c.byTagId': TMSU is a one-shot-per-invocation CLI, so a
+// fresh process's in-memory index is empty even though the 'query_cache'
+// table it shares with every other invocation is not. Invalidation has to be
+// driven from the database or it silently misses every entry this process
+// never itself read into memory.
+func (c *queryCache) invalidateTag(tx *Tx, tagId entities.TagId) error {
+	keys, err := queryCacheKeysForTag(tx, tagId)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		c.remove(key)
+		if err := deleteQueryCacheRow(tx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// invalidateValue drops every cached entry that depends on the specified
+// value. See 'invalidateTag' for why this is driven from the database rather
+// than 'c.byValueId'.
+func (c *queryCache) invalidateValue(tx *Tx, valueId entities.ValueId) error {
+	keys, err := queryCacheKeysForValue(tx, valueId)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		c.remove(key)
+		if err := deleteQueryCacheRow(tx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// invalidateFileTagCache drops every cached entry that depends on the tag or value
+// affected by a mutation to 'file_tag'.
+func invalidateFileTagCache(tx *Tx, tagId entities.TagId, valueId entities.ValueId) error {
+	if err := fileTagQueryCache.invalidateTag(tx, tagId); err != nil {
+		return err
+	}
+
+	if valueId != 0 {
+		if err := fileTagQueryCache.invalidateValue(tx, valueId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dependencies walks the query expression collecting the tag and value
+// identifiers it references, including those pulled in transitively via
+// 'implication', so that the cache entry can be invalidated precisely.
+func dependencies(tx *Tx, expression query.Expression) (map[entities.TagId]struct{}, map[entities.ValueId]struct{}, error) {
+	tagIds := make(map[entities.TagId]struct{})
+	valueIds := make(map[entities.ValueId]struct{})
+
+	if err := collectDependencies(tx, expression, tagIds, valueIds); err != nil {
+		return nil, nil, err
+	}
+
+	return tagIds, valueIds, nil
+}
+
+func collectDependencies(tx *Tx, expression query.Expression, tagIds map[entities.TagId]struct{}, valueIds map[entities.ValueId]struct{}) error {
+	switch exp := expression.(type) {
+	case query.TagExpression:
+		return collectTagClosure(tx, exp.Name, tagIds)
+	case query.AllValuesExpression:
+		return collectTagClosure(tx, exp.Name, tagIds)
+	case query.ComparisonExpression:
+		if err := collectTagClosure(tx, exp.Tag.Name, tagIds); err != nil {
+			return err
+		}
+		return collectValueClosure(tx, exp.Value.Name, valueIds)
+	case query.AndExpression:
+		if err := collectDependencies(tx, exp.LeftOperand, tagIds, valueIds); err != nil {
+			return err
+		}
+		return collectDependencies(tx, exp.RightOperand, tagIds, valueIds)
+	case query.OrExpression:
+		if err := collectDependencies(tx, exp.LeftOperand, tagIds, valueIds); err != nil {
+			return err
+		}
+		return collectDependencies(tx, exp.RightOperand, tagIds, valueIds)
+	case query.NotExpression:
+		return collectDependencies(tx, exp.Operand, tagIds, valueIds)
+	case query.EmptyExpression:
+		return nil
+	default:
+		return nil
+	}
+}
+
+// collectTagClosure adds the identifier of the named tag and every tag that
+// implies it, directly or transitively, to 'tagIds'.
+func collectTagClosure(tx *Tx, name string, tagIds map[entities.TagId]struct{}) error {
+	sql := `
+WITH RECURSIVE working (tag_id) AS
+(
+    SELECT id
+    FROM tag
+    WHERE name = ?1
+    UNION ALL
+    SELECT b.tag_id
+    FROM implication b, working
+    WHERE b.implied_tag_id = working.tag_id
+)
+SELECT tag_id
+FROM working`
+
+	rows, err := tx.Query(sql, name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		var tagId entities.TagId
+		if err := rows.Scan(&tagId); err != nil {
+			return err
+		}
+
+		tagIds[tagId] = struct{}{}
+	}
+
+	return nil
+}
+
+// collectValueClosure adds the identifier of the named value to 'valueIds' so
+// that a cached 'tag == value' / 'tag != value' comparison is invalidated
+// when that value's rows are dropped in bulk, e.g. by
+// 'DeleteFileTagsByValueId'.
+func collectValueClosure(tx *Tx, name string, valueIds map[entities.ValueId]struct{}) error {
+	sql := `
+SELECT id
+FROM value
+WHERE name = ?1`
+
+	rows, err := tx.Query(sql, name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		var valueId entities.ValueId
+		if err := rows.Scan(&valueId); err != nil {
+			return err
+		}
+
+		valueIds[valueId] = struct{}{}
+	}
+
+	return nil
+}
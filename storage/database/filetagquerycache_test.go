@@ -0,0 +1,98 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"github.com/oniony/TMSU/entities"
+	"github.com/oniony/TMSU/query"
+	"testing"
+)
+
+// These two tests cover only the in-process half of invalidation: the
+// bookkeeping 'remove' performs on 'c.entries'/'c.byTagId'/'c.byValueId' once
+// a key is known to need dropping. The database-driven half — finding that
+// key in the first place via 'queryCacheKeysForTag'/'queryCacheKeysForValue'
+// against the 'query_cache_tags'/'query_cache_values' tables, which is what
+// makes invalidation work across separate CLI invocations — needs a real
+// '*Tx', and this snapshot of the tree does not carry the sqlite driver glue
+// that would let a test open one.
+
+func TestQueryCacheRemoveDropsEntryAndTagIndex(t *testing.T) {
+	cache := newQueryCache(10)
+
+	cache.store("matching", entities.TagValuePairs{}, map[entities.TagId]struct{}{1: {}}, nil)
+	cache.store("unrelated", entities.TagValuePairs{}, map[entities.TagId]struct{}{2: {}}, nil)
+
+	cache.remove("matching")
+
+	if _, found := cache.entries["matching"]; found {
+		t.Error("expected entry depending on the touched tag to be dropped")
+	}
+	if _, found := cache.byTagId[1]["matching"]; found {
+		t.Error("expected reverse tag index to be cleaned up for the dropped entry")
+	}
+
+	if _, found := cache.entries["unrelated"]; !found {
+		t.Error("expected entry depending on an untouched tag to survive")
+	}
+}
+
+func TestQueryCacheRemoveDropsEntryAndValueIndex(t *testing.T) {
+	cache := newQueryCache(10)
+
+	cache.store("matching", entities.TagValuePairs{}, nil, map[entities.ValueId]struct{}{5: {}})
+	cache.store("unrelated", entities.TagValuePairs{}, nil, map[entities.ValueId]struct{}{6: {}})
+
+	cache.remove("matching")
+
+	if _, found := cache.entries["matching"]; found {
+		t.Error("expected entry depending on the touched value to be dropped")
+	}
+	if _, found := cache.byValueId[5]["matching"]; found {
+		t.Error("expected reverse value index to be cleaned up for the dropped entry")
+	}
+
+	if _, found := cache.entries["unrelated"]; !found {
+		t.Error("expected entry depending on an untouched value to survive")
+	}
+}
+
+func TestQueryCacheEvictsOldestEntryOnceOverCapacity(t *testing.T) {
+	cache := newQueryCache(1)
+
+	cache.store("first", entities.TagValuePairs{}, map[entities.TagId]struct{}{1: {}}, nil)
+	cache.store("second", entities.TagValuePairs{}, map[entities.TagId]struct{}{2: {}}, nil)
+
+	if _, found := cache.entries["first"]; found {
+		t.Error("expected the oldest entry to be evicted once over capacity")
+	}
+	if _, found := cache.entries["second"]; !found {
+		t.Error("expected the most recently stored entry to be retained")
+	}
+}
+
+func TestHashExpressionIsStableAndDiscriminating(t *testing.T) {
+	a := query.TagExpression{Name: "a"}
+	anotherA := query.TagExpression{Name: "a"}
+	b := query.TagExpression{Name: "b"}
+
+	if hashExpression(a) != hashExpression(anotherA) {
+		t.Error("expected the same expression to always hash to the same key")
+	}
+	if hashExpression(a) == hashExpression(b) {
+		t.Error("expected different expressions to hash to different keys")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"github.com/oniony/TMSU/entities"
+	"time"
+)
+
+// TagUsage is an aggregated access-frequency record for a tag/value
+// combination, read back from 'file_tag_usage'.
+type TagUsage struct {
+	TagId      entities.TagId
+	ValueId    entities.ValueId
+	QueryCount uint
+	LastUsedAt time.Time
+}
+
+// ensureFileTagUsageTable creates the 'file_tag_usage' table the first time
+// it is needed. It is idempotent, so it is safe to call before every access
+// to the table.
+func ensureFileTagUsageTable(tx *Tx) error {
+	sql := `
+CREATE TABLE IF NOT EXISTS file_tag_usage (
+    tag_id INTEGER NOT NULL,
+    value_id INTEGER NOT NULL,
+    query_count INTEGER NOT NULL,
+    last_used_at DATETIME NOT NULL,
+    PRIMARY KEY (tag_id, value_id)
+)`
+
+	_, err := tx.Exec(sql)
+	return err
+}
+
+// bumpFileTagUsage records that the specified tags and values were
+// referenced by a query, incrementing 'query_count' and refreshing
+// 'last_used_at' for each. It is called on every 'FileTagsForQuery'
+// invocation, cache hit or miss, with the same dependency set used to
+// populate the query cache.
+func bumpFileTagUsage(tx *Tx, tagIds map[entities.TagId]struct{}, valueIds map[entities.ValueId]struct{}) error {
+	if err := ensureFileTagUsageTable(tx); err != nil {
+		return err
+	}
+
+	sql := `
+INSERT INTO file_tag_usage (tag_id, value_id, query_count, last_used_at)
+VALUES (?1, ?2, 1, ?3)
+ON CONFLICT (tag_id, value_id) DO UPDATE SET
+    query_count = query_count + 1,
+    last_used_at = ?3`
+
+	now := time.Now()
+
+	for tagId := range tagIds {
+		if _, err := tx.Exec(sql, tagId, 0, now); err != nil {
+			return err
+		}
+	}
+
+	for valueId := range valueIds {
+		if _, err := tx.Exec(sql, 0, valueId, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GcFileTagUsage deletes usage rows that have not been touched since
+// 'olderThan'. It only ever removes rows, so it is safe to run concurrently
+// with readers of 'file_tag_usage'.
+func GcFileTagUsage(tx *Tx, olderThan time.Time) error {
+	if err := ensureFileTagUsageTable(tx); err != nil {
+		return err
+	}
+
+	sql := `
+DELETE FROM file_tag_usage
+WHERE last_used_at < ?1`
+
+	_, err := tx.Exec(sql, olderThan)
+	return err
+}
+
+// deleteFileTagUsageByTagId removes the usage row for the specified tag. It
+// is called by 'DeleteFileTagsByTagId' so that a deleted tag's usage record
+// does not linger until the next time-based 'GcFileTagUsage' sweep.
+func deleteFileTagUsageByTagId(tx *Tx, tagId entities.TagId) error {
+	if err := ensureFileTagUsageTable(tx); err != nil {
+		return err
+	}
+
+	sql := `
+DELETE FROM file_tag_usage
+WHERE tag_id = ?1 AND value_id = 0`
+
+	_, err := tx.Exec(sql, tagId)
+	return err
+}
+
+// deleteFileTagUsageByValueId removes the usage row for the specified value.
+// It is called by 'DeleteFileTagsByValueId' so that a deleted value's usage
+// record does not linger until the next time-based 'GcFileTagUsage' sweep.
+func deleteFileTagUsageByValueId(tx *Tx, valueId entities.ValueId) error {
+	if err := ensureFileTagUsageTable(tx); err != nil {
+		return err
+	}
+
+	sql := `
+DELETE FROM file_tag_usage
+WHERE tag_id = 0 AND value_id = ?1`
+
+	_, err := tx.Exec(sql, valueId)
+	return err
+}
+
+// MostUsedTags retrieves the 'n' tags with the highest query counts.
+func MostUsedTags(tx *Tx, n uint) ([]TagUsage, error) {
+	if err := ensureFileTagUsageTable(tx); err != nil {
+		return nil, err
+	}
+
+	sql := `
+SELECT tag_id, value_id, query_count, last_used_at
+FROM file_tag_usage
+WHERE tag_id != 0
+ORDER BY query_count DESC
+LIMIT ?1`
+
+	rows, err := tx.Query(sql, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return readTagUsages(rows)
+}
+
+// UnusedTags retrieves the tags whose usage row was last touched before
+// 'olderThan'. Tags that have never been referenced by a query have no usage
+// row and are not returned.
+func UnusedTags(tx *Tx, olderThan time.Time) ([]TagUsage, error) {
+	if err := ensureFileTagUsageTable(tx); err != nil {
+		return nil, err
+	}
+
+	sql := `
+SELECT tag_id, value_id, query_count, last_used_at
+FROM file_tag_usage
+WHERE tag_id != 0 AND last_used_at < ?1
+ORDER BY last_used_at ASC`
+
+	rows, err := tx.Query(sql, olderThan)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return readTagUsages(rows)
+}
+
+func readTagUsages(rows *sql.Rows) ([]TagUsage, error) {
+	usages := make([]TagUsage, 0, 10)
+
+	for rows.Next() {
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+
+		var usage TagUsage
+		if err := rows.Scan(&usage.TagId, &usage.ValueId, &usage.QueryCount, &usage.LastUsedAt); err != nil {
+			return nil, err
+		}
+
+		usages = append(usages, usage)
+	}
+
+	return usages, nil
+}
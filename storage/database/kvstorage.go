@@ -0,0 +1,725 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"encoding/binary"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/boltdb/bolt"
+	"github.com/oniony/TMSU/entities"
+	"github.com/oniony/TMSU/query"
+	"sort"
+	"strconv"
+)
+
+// KVStorage is an embedded, pure-Go alternative to the SQLite backend. It
+// keeps three indexes so that every "...ByX" lookup is a direct prefix scan
+// rather than a table scan, and evaluates queries by walking the expression
+// tree directly instead of generating SQL.
+//
+//	byFile    maps file_id  -> {tag_id, value_id}
+//	byTag     maps tag_id   -> {file_id, value_id}
+//	byValue   maps value_id -> {file_id, tag_id}
+//	tagName   maps tag_id   -> name, tagId maps name -> tag_id
+//	valueName maps value_id -> name, valueId maps name -> value_id
+//
+// Known divergence from the SQLite backend: implications here are
+// tag-to-tag only (see 'AddImplication'). The SQLite backend's 'implication'
+// table additionally scopes an implication to a specific value (e.g. "colour
+// = red" implying "warm" without "colour = blue" doing the same), via
+// 'implied_value_id' in the recursive CTE built by
+// 'buildFileTagComparisonQueryBranch'. There is currently no way to create
+// such a value-scoped implication
+// through this backend's API, so a tree relying on one will behave
+// differently depending on which backend it is queried through.
+type KVStorage struct {
+	db       *bolt.DB
+	tx       *bolt.Tx
+	closures map[entities.TagId]*roaring.Bitmap // tag_id -> implying tag ids, built once per transaction
+}
+
+const (
+	byFileBucket    = "byFile"
+	byTagBucket     = "byTag"
+	byValueBucket   = "byValue"
+	implBucket      = "implication"
+	tagNameBucket   = "tagName"
+	tagIdBucket     = "tagId"
+	valueNameBucket = "valueName"
+	valueIdBucket   = "valueId"
+)
+
+// NewKVStorage opens (creating if necessary) the indexes inside a BoltDB
+// file and returns the database; 'NewKVStorageTx' binds one of its
+// transactions as a 'Storage'.
+func NewKVStorage(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []string{
+		byFileBucket, byTagBucket, byValueBucket, implBucket,
+		tagNameBucket, tagIdBucket, valueNameBucket, valueIdBucket,
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewKVStorageTx binds a 'KVStorage' to an in-flight BoltDB transaction.
+func NewKVStorageTx(tx *bolt.Tx) *KVStorage {
+	return &KVStorage{tx: tx, closures: make(map[entities.TagId]*roaring.Bitmap)}
+}
+
+func compositeKey(a, b uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[0:8], a)
+	binary.BigEndian.PutUint64(key[8:16], b)
+	return key
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func (s *KVStorage) FileTagExists(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) (bool, error) {
+	bucket := s.tx.Bucket([]byte(byFileBucket))
+	return bucket.Get(append(compositeKey(uint64(fileId), uint64(tagId)), compositeKey(uint64(valueId), 0)...)) != nil, nil
+}
+
+func (s *KVStorage) put(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) error {
+	byFile := s.tx.Bucket([]byte(byFileBucket))
+	byTag := s.tx.Bucket([]byte(byTagBucket))
+	byValue := s.tx.Bucket([]byte(byValueBucket))
+
+	if err := byFile.Put(append(compositeKey(uint64(fileId), uint64(tagId)), compositeKey(uint64(valueId), 0)...), []byte{1}); err != nil {
+		return err
+	}
+	if err := byTag.Put(append(compositeKey(uint64(tagId), uint64(fileId)), compositeKey(uint64(valueId), 0)...), []byte{1}); err != nil {
+		return err
+	}
+	if err := byValue.Put(append(compositeKey(uint64(valueId), uint64(fileId)), compositeKey(uint64(tagId), 0)...), []byte{1}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *KVStorage) del(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) error {
+	byFile := s.tx.Bucket([]byte(byFileBucket))
+	byTag := s.tx.Bucket([]byte(byTagBucket))
+	byValue := s.tx.Bucket([]byte(byValueBucket))
+
+	if err := byFile.Delete(append(compositeKey(uint64(fileId), uint64(tagId)), compositeKey(uint64(valueId), 0)...)); err != nil {
+		return err
+	}
+	if err := byTag.Delete(append(compositeKey(uint64(tagId), uint64(fileId)), compositeKey(uint64(valueId), 0)...)); err != nil {
+		return err
+	}
+	if err := byValue.Delete(append(compositeKey(uint64(valueId), uint64(fileId)), compositeKey(uint64(tagId), 0)...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *KVStorage) AddFileTag(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) (*entities.FileTag, error) {
+	if err := s.put(fileId, tagId, valueId); err != nil {
+		return nil, err
+	}
+	return &entities.FileTag{fileId, tagId, valueId, true, false}, nil
+}
+
+func (s *KVStorage) AddFileTags(triples []FileTagTriple) ([]*entities.FileTag, error) {
+	fileTags := make([]*entities.FileTag, 0, len(triples))
+	for _, triple := range triples {
+		fileTag, err := s.AddFileTag(triple.FileId, triple.TagId, triple.ValueId)
+		if err != nil {
+			return nil, err
+		}
+		fileTags = append(fileTags, fileTag)
+	}
+	return fileTags, nil
+}
+
+func (s *KVStorage) DeleteFileTag(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) error {
+	exists, err := s.FileTagExists(fileId, tagId, valueId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NoSuchFileTagError{fileId, tagId, valueId}
+	}
+
+	return s.del(fileId, tagId, valueId)
+}
+
+func (s *KVStorage) DeleteFileTags(triples []FileTagTriple) ([]FileTagTriple, error) {
+	notFound := make([]FileTagTriple, 0)
+	for _, triple := range triples {
+		if err := s.DeleteFileTag(triple.FileId, triple.TagId, triple.ValueId); err != nil {
+			if _, ok := err.(NoSuchFileTagError); ok {
+				notFound = append(notFound, triple)
+				continue
+			}
+			return nil, err
+		}
+	}
+	return notFound, nil
+}
+
+// tagClosure returns the set of tag ids that imply 'tagId', directly or
+// transitively, building the map once per transaction from the
+// 'implication' bucket.
+func (s *KVStorage) tagClosure(tagId entities.TagId) (*roaring.Bitmap, error) {
+	if closure, ok := s.closures[tagId]; ok {
+		return closure, nil
+	}
+
+	closure := roaring.New()
+	closure.Add(uint32(tagId))
+
+	implBucket := s.tx.Bucket([]byte(implBucket))
+	cursor := implBucket.Cursor()
+
+	frontier := []entities.TagId{tagId}
+	for len(frontier) > 0 {
+		current := frontier[0]
+		frontier = frontier[1:]
+
+		prefix := compositeKey(uint64(current), 0)[0:8]
+		for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(current); k, _ = cursor.Next() {
+			impliedBy := entities.TagId(binary.BigEndian.Uint64(k[8:16]))
+			if !closure.Contains(uint32(impliedBy)) {
+				closure.Add(uint32(impliedBy))
+				frontier = append(frontier, impliedBy)
+			}
+		}
+	}
+
+	s.closures[tagId] = closure
+	return closure, nil
+}
+
+// filesForTag returns the roaring bitmap of file ids bearing 'tagId' (any
+// value when valueId is zero), including files tagged via implication.
+func (s *KVStorage) filesForTag(tagId entities.TagId, valueId entities.ValueId) (*roaring.Bitmap, error) {
+	closure, err := s.tagClosure(tagId)
+	if err != nil {
+		return nil, err
+	}
+
+	files := roaring.New()
+	byTag := s.tx.Bucket([]byte(byTagBucket))
+
+	iterator := closure.Iterator()
+	for iterator.HasNext() {
+		impliedBy := entities.TagId(iterator.Next())
+
+		cursor := byTag.Cursor()
+		prefix := compositeKey(uint64(impliedBy), 0)[0:8]
+		for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(impliedBy); k, _ = cursor.Next() {
+			fileId := binary.BigEndian.Uint64(k[8:16])
+			entryValueId := entities.ValueId(binary.BigEndian.Uint64(k[16:24]))
+			if valueId == 0 || entryValueId == valueId {
+				files.Add(uint32(fileId))
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// SetTagName records the display name for a tag id, keeping both the
+// id->name and name->id indexes in step. Callers that create tags are
+// responsible for calling this so that 'FileTagsForQuery' and query
+// expression lookups can resolve names without consulting SQLite.
+func (s *KVStorage) SetTagName(tagId entities.TagId, name string) error {
+	if err := s.tx.Bucket([]byte(tagNameBucket)).Put(idKey(uint64(tagId)), []byte(name)); err != nil {
+		return err
+	}
+	return s.tx.Bucket([]byte(tagIdBucket)).Put([]byte(name), idKey(uint64(tagId)))
+}
+
+// SetValueName records the display name for a value id, keeping both the
+// id->name and name->id indexes in step.
+func (s *KVStorage) SetValueName(valueId entities.ValueId, name string) error {
+	if err := s.tx.Bucket([]byte(valueNameBucket)).Put(idKey(uint64(valueId)), []byte(name)); err != nil {
+		return err
+	}
+	return s.tx.Bucket([]byte(valueIdBucket)).Put([]byte(name), idKey(uint64(valueId)))
+}
+
+// tagIdByName resolves a tag's id from its name via the 'tagId' index.
+func (s *KVStorage) tagIdByName(name string) (entities.TagId, bool, error) {
+	raw := s.tx.Bucket([]byte(tagIdBucket)).Get([]byte(name))
+	if raw == nil {
+		return 0, false, nil
+	}
+	return entities.TagId(binary.BigEndian.Uint64(raw)), true, nil
+}
+
+// valueIdByName resolves a value's id from its name via the 'valueId' index.
+func (s *KVStorage) valueIdByName(name string) (entities.ValueId, bool, error) {
+	raw := s.tx.Bucket([]byte(valueIdBucket)).Get([]byte(name))
+	if raw == nil {
+		return 0, false, nil
+	}
+	return entities.ValueId(binary.BigEndian.Uint64(raw)), true, nil
+}
+
+// tagNameById resolves a tag's display name from its id, returning "" if it
+// has not been recorded via 'SetTagName'.
+func (s *KVStorage) tagNameById(tagId entities.TagId) string {
+	raw := s.tx.Bucket([]byte(tagNameBucket)).Get(idKey(uint64(tagId)))
+	if raw == nil {
+		return ""
+	}
+	return string(raw)
+}
+
+// valueNameById resolves a value's display name from its id, returning "" if
+// it has not been recorded via 'SetValueName'.
+func (s *KVStorage) valueNameById(valueId entities.ValueId) string {
+	if valueId == 0 {
+		return ""
+	}
+
+	raw := s.tx.Bucket([]byte(valueNameBucket)).Get(idKey(uint64(valueId)))
+	if raw == nil {
+		return ""
+	}
+	return string(raw)
+}
+
+// AddImplication records that tagging a file with 'tagId' also implies
+// 'impliedTagId', so that 'tagClosure' expands past the literal tag when
+// evaluating a query against 'impliedTagId'.
+//
+// Unlike the SQLite backend's 'implication' table, this is tag-to-tag only:
+// there is no way to scope the implication to one of 'tagId's values, so a
+// tree that depends on a value-scoped implication (see the 'KVStorage' doc
+// comment) will not see the same results through this backend.
+func (s *KVStorage) AddImplication(tagId entities.TagId, impliedTagId entities.TagId) error {
+	if err := s.tx.Bucket([]byte(implBucket)).Put(compositeKey(uint64(impliedTagId), uint64(tagId)), []byte{1}); err != nil {
+		return err
+	}
+	s.closures = make(map[entities.TagId]*roaring.Bitmap)
+	return nil
+}
+
+// RemoveImplication removes a previously recorded implication.
+func (s *KVStorage) RemoveImplication(tagId entities.TagId, impliedTagId entities.TagId) error {
+	if err := s.tx.Bucket([]byte(implBucket)).Delete(compositeKey(uint64(impliedTagId), uint64(tagId))); err != nil {
+		return err
+	}
+	s.closures = make(map[entities.TagId]*roaring.Bitmap)
+	return nil
+}
+
+// evaluate walks the query expression tree, intersecting/unioning file id
+// bitmaps for And/Or/Not rather than generating the CTE-based SQL that the
+// SQLite backend relies on.
+func (s *KVStorage) evaluate(expression query.Expression) (*roaring.Bitmap, error) {
+	switch exp := expression.(type) {
+	case query.EmptyExpression:
+		return s.allFileIds()
+	case query.TagExpression:
+		return s.filesForTagName(exp.Name)
+	case query.AllValuesExpression:
+		return s.filesForTagName(exp.Name)
+	case query.ComparisonExpression:
+		return s.evaluateComparison(exp)
+	case query.AndExpression:
+		left, err := s.evaluate(exp.LeftOperand)
+		if err != nil {
+			return nil, err
+		}
+		right, err := s.evaluate(exp.RightOperand)
+		if err != nil {
+			return nil, err
+		}
+		return roaring.And(left, right), nil
+	case query.OrExpression:
+		left, err := s.evaluate(exp.LeftOperand)
+		if err != nil {
+			return nil, err
+		}
+		right, err := s.evaluate(exp.RightOperand)
+		if err != nil {
+			return nil, err
+		}
+		return roaring.Or(left, right), nil
+	case query.NotExpression:
+		inner, err := s.evaluate(exp.Operand)
+		if err != nil {
+			return nil, err
+		}
+		all, err := s.allFileIds()
+		if err != nil {
+			return nil, err
+		}
+		return roaring.AndNot(all, inner), nil
+	default:
+		panic("Unsupported expression type.")
+	}
+}
+
+// filesForTagName resolves 'name' to a tag id and returns the files bearing
+// it with any value, including those tagged via implication. An unknown name
+// matches no files.
+func (s *KVStorage) filesForTagName(name string) (*roaring.Bitmap, error) {
+	tagId, ok, err := s.tagIdByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return roaring.New(), nil
+	}
+
+	return s.filesForTag(tagId, 0)
+}
+
+// evaluateComparison evaluates a 'tag == value' / 'tag != value' / 'tag <
+// value' style expression. Equality and inequality are resolved against the
+// exact value id, mirroring 'buildFileTagComparisonQueryBranch' (including
+// reinterpreting '!=' as "not tagged with exactly this value", which matches
+// files lacking the tag altogether too). The ordering operators fall back to
+// comparing every implied value's name against 'exp.Value.Name': numerically
+// when 'exp.Value.Name' parses as a float, in which case value names that do
+// not parse never match, and lexicographically otherwise.
+func (s *KVStorage) evaluateComparison(exp query.ComparisonExpression) (*roaring.Bitmap, error) {
+	tagId, ok, err := s.tagIdByName(exp.Tag.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return roaring.New(), nil
+	}
+
+	if exp.Operator == "==" || exp.Operator == "!=" {
+		var matching *roaring.Bitmap
+
+		valueId, ok, err := s.valueIdByName(exp.Value.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matching, err = s.filesForTag(tagId, valueId)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			matching = roaring.New()
+		}
+
+		if exp.Operator == "==" {
+			return matching, nil
+		}
+
+		all, err := s.allFileIds()
+		if err != nil {
+			return nil, err
+		}
+		return roaring.AndNot(all, matching), nil
+	}
+
+	return s.filesForTagValueCompare(tagId, exp.Operator, exp.Value.Name)
+}
+
+// filesForTagValueCompare returns the files tagged (directly or via
+// implication) with 'tagId' where the applied value compares true against
+// 'compareTo' under 'operator'.
+func (s *KVStorage) filesForTagValueCompare(tagId entities.TagId, operator string, compareTo string) (*roaring.Bitmap, error) {
+	closure, err := s.tagClosure(tagId)
+	if err != nil {
+		return nil, err
+	}
+
+	target, numeric := 0.0, false
+	if parsed, err := strconv.ParseFloat(compareTo, 64); err == nil {
+		target = parsed
+		numeric = true
+	}
+
+	files := roaring.New()
+	byTag := s.tx.Bucket([]byte(byTagBucket))
+	valueNames := s.tx.Bucket([]byte(valueNameBucket))
+
+	iterator := closure.Iterator()
+	for iterator.HasNext() {
+		impliedBy := entities.TagId(iterator.Next())
+
+		cursor := byTag.Cursor()
+		prefix := compositeKey(uint64(impliedBy), 0)[0:8]
+		for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(impliedBy); k, _ = cursor.Next() {
+			fileId := binary.BigEndian.Uint64(k[8:16])
+			entryValueId := entities.ValueId(binary.BigEndian.Uint64(k[16:24]))
+			if entryValueId == 0 {
+				continue
+			}
+
+			raw := valueNames.Get(idKey(uint64(entryValueId)))
+			if raw == nil {
+				continue
+			}
+			name := string(raw)
+
+			var matched bool
+			if numeric {
+				if parsed, err := strconv.ParseFloat(name, 64); err == nil {
+					matched = compareFloats(parsed, operator, target)
+				}
+			} else {
+				matched = compareStrings(name, operator, compareTo)
+			}
+
+			if matched {
+				files.Add(uint32(fileId))
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// compareFloats applies a SQL-style comparison operator ("<", ">", "<=",
+// ">=", "==" or "!=") to a pair of numeric operands.
+func compareFloats(a float64, operator string, b float64) bool {
+	switch operator {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case ">":
+		return a > b
+	case "<=":
+		return a <= b
+	case ">=":
+		return a >= b
+	default:
+		return false
+	}
+}
+
+// compareStrings applies a SQL-style comparison operator ("<", ">", "<=",
+// ">=", "==" or "!=") to a pair of string operands.
+func compareStrings(a string, operator string, b string) bool {
+	switch operator {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case ">":
+		return a > b
+	case "<=":
+		return a <= b
+	case ">=":
+		return a >= b
+	default:
+		return false
+	}
+}
+
+func (s *KVStorage) allFileIds() (*roaring.Bitmap, error) {
+	all := roaring.New()
+	cursor := s.tx.Bucket([]byte(byFileBucket)).Cursor()
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		all.Add(uint32(binary.BigEndian.Uint64(k[0:8])))
+	}
+	return all, nil
+}
+
+// FileTagsForQuery evaluates 'expression' against the roaring-bitmap indexes
+// and returns the distinct tag/value pairs applied to the matching files,
+// mirroring the SQLite backend's 'buildFileTagsQuery'. Names are resolved via
+// the 'tagName'/'valueName' buckets, which are only populated for tags and
+// values created through 'SetTagName'/'SetValueName'; anything else comes
+// back with an empty name.
+func (s *KVStorage) FileTagsForQuery(expression query.Expression) (entities.TagValuePairs, error) {
+	fileIds, err := s.evaluate(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	type tagValueKey struct {
+		tagId   entities.TagId
+		valueId entities.ValueId
+	}
+	seen := make(map[tagValueKey]struct{})
+
+	byFile := s.tx.Bucket([]byte(byFileBucket))
+	pairs := make(entities.TagValuePairs, 0, 10)
+
+	iterator := fileIds.Iterator()
+	for iterator.HasNext() {
+		fileId := iterator.Next()
+
+		cursor := byFile.Cursor()
+		prefix := compositeKey(uint64(fileId), 0)[0:8]
+		for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(fileId); k, _ = cursor.Next() {
+			tagId := entities.TagId(binary.BigEndian.Uint64(k[8:16]))
+			valueId := entities.ValueId(binary.BigEndian.Uint64(k[16:24]))
+
+			key := tagValueKey{tagId, valueId}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			pairs = append(pairs, &entities.TagValuePair{
+				entities.Tag{tagId, s.tagNameById(tagId)},
+				entities.Value{valueId, s.valueNameById(valueId)},
+			})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Tag.Name != pairs[j].Tag.Name {
+			return pairs[i].Tag.Name < pairs[j].Tag.Name
+		}
+		return pairs[i].Value.Name < pairs[j].Value.Name
+	})
+
+	return pairs, nil
+}
+
+func (s *KVStorage) FileTagCount() (uint, error) {
+	count := uint(0)
+	cursor := s.tx.Bucket([]byte(byFileBucket)).Cursor()
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		count++
+	}
+	return count, nil
+}
+
+func (s *KVStorage) FileTags() (entities.FileTags, error) {
+	fileTags := make(entities.FileTags, 0, 10)
+	cursor := s.tx.Bucket([]byte(byFileBucket)).Cursor()
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		fileId := entities.FileId(binary.BigEndian.Uint64(k[0:8]))
+		tagId := entities.TagId(binary.BigEndian.Uint64(k[8:16]))
+		valueId := entities.ValueId(binary.BigEndian.Uint64(k[16:24]))
+		fileTags = append(fileTags, &entities.FileTag{fileId, tagId, valueId, true, false})
+	}
+	return fileTags, nil
+}
+
+func (s *KVStorage) FileTagsByFileId(fileId entities.FileId) (entities.FileTags, error) {
+	fileTags := make(entities.FileTags, 0, 10)
+	cursor := s.tx.Bucket([]byte(byFileBucket)).Cursor()
+	prefix := compositeKey(uint64(fileId), 0)[0:8]
+	for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(fileId); k, _ = cursor.Next() {
+		tagId := entities.TagId(binary.BigEndian.Uint64(k[8:16]))
+		valueId := entities.ValueId(binary.BigEndian.Uint64(k[16:24]))
+		fileTags = append(fileTags, &entities.FileTag{fileId, tagId, valueId, true, false})
+	}
+	return fileTags, nil
+}
+
+func (s *KVStorage) FileTagsByTagId(tagId entities.TagId) (entities.FileTags, error) {
+	fileTags := make(entities.FileTags, 0, 10)
+	cursor := s.tx.Bucket([]byte(byTagBucket)).Cursor()
+	prefix := compositeKey(uint64(tagId), 0)[0:8]
+	for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(tagId); k, _ = cursor.Next() {
+		fileId := entities.FileId(binary.BigEndian.Uint64(k[8:16]))
+		valueId := entities.ValueId(binary.BigEndian.Uint64(k[16:24]))
+		fileTags = append(fileTags, &entities.FileTag{fileId, tagId, valueId, true, false})
+	}
+	return fileTags, nil
+}
+
+func (s *KVStorage) FileTagsByValueId(valueId entities.ValueId) (entities.FileTags, error) {
+	fileTags := make(entities.FileTags, 0, 10)
+	cursor := s.tx.Bucket([]byte(byValueBucket)).Cursor()
+	prefix := compositeKey(uint64(valueId), 0)[0:8]
+	for k, _ := cursor.Seek(prefix); k != nil && len(k) >= 8 && binary.BigEndian.Uint64(k[0:8]) == uint64(valueId); k, _ = cursor.Next() {
+		fileId := entities.FileId(binary.BigEndian.Uint64(k[8:16]))
+		tagId := entities.TagId(binary.BigEndian.Uint64(k[16:24]))
+		fileTags = append(fileTags, &entities.FileTag{fileId, tagId, valueId, true, false})
+	}
+	return fileTags, nil
+}
+
+func (s *KVStorage) DeleteFileTagsByFileId(fileId entities.FileId) error {
+	fileTags, err := s.FileTagsByFileId(fileId)
+	if err != nil {
+		return err
+	}
+	for _, fileTag := range fileTags {
+		if err := s.del(fileTag.FileId, fileTag.TagId, fileTag.ValueId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *KVStorage) DeleteFileTagsByTagId(tagId entities.TagId) error {
+	fileTags, err := s.FileTagsByTagId(tagId)
+	if err != nil {
+		return err
+	}
+	for _, fileTag := range fileTags {
+		if err := s.del(fileTag.FileId, fileTag.TagId, fileTag.ValueId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *KVStorage) DeleteFileTagsByValueId(valueId entities.ValueId) error {
+	fileTags, err := s.FileTagsByValueId(valueId)
+	if err != nil {
+		return err
+	}
+	for _, fileTag := range fileTags {
+		if err := s.del(fileTag.FileId, fileTag.TagId, fileTag.ValueId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *KVStorage) CopyFileTags(sourceTagId entities.TagId, destTagId entities.TagId) error {
+	fileTags, err := s.FileTagsByTagId(sourceTagId)
+	if err != nil {
+		return err
+	}
+	for _, fileTag := range fileTags {
+		if err := s.put(fileTag.FileId, destTagId, fileTag.ValueId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/oniony/TMSU/entities"
+	"github.com/oniony/TMSU/query"
+	"os"
+	"testing"
+)
+
+// withKVStorage opens a throwaway BoltDB file and runs 'fn' with a
+// 'KVStorage' bound to a single read-write transaction, mirroring how
+// 'NewKVStorage'/'NewKVStorageTx' are used together in production.
+func withKVStorage(t *testing.T, fn func(s *KVStorage)) {
+	t.Helper()
+
+	file, err := os.CreateTemp("", "kvstorage_test")
+	if err != nil {
+		t.Fatalf("could not create temp file: %v", err)
+	}
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+
+	db, err := NewKVStorage(path)
+	if err != nil {
+		t.Fatalf("could not open KVStorage: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		fn(NewKVStorageTx(tx))
+		return nil
+	}); err != nil {
+		t.Fatalf("transaction failed: %v", err)
+	}
+}
+
+func TestKVStorageAddDeleteFileTagRoundTrips(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if _, err := s.AddFileTag(1, 2, 3); err != nil {
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		exists, err := s.FileTagExists(1, 2, 3)
+		if err != nil {
+			t.Fatalf("FileTagExists failed: %v", err)
+		}
+		if !exists {
+			t.Error("expected file tag to exist after AddFileTag")
+		}
+
+		if err := s.DeleteFileTag(1, 2, 3); err != nil {
+			t.Fatalf("DeleteFileTag failed: %v", err)
+		}
+
+		exists, err = s.FileTagExists(1, 2, 3)
+		if err != nil {
+			t.Fatalf("FileTagExists failed: %v", err)
+		}
+		if exists {
+			t.Error("expected file tag to be gone after DeleteFileTag")
+		}
+	})
+}
+
+func TestKVStorageDeleteFileTagReturnsNoSuchFileTagError(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		err := s.DeleteFileTag(1, 2, 3)
+		if _, ok := err.(NoSuchFileTagError); !ok {
+			t.Errorf("expected NoSuchFileTagError, got: %v", err)
+		}
+	})
+}
+
+func TestKVStorageFilesForTagNameIncludesImplication(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if err := s.SetTagName(1, "specific"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if err := s.SetTagName(2, "general"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if err := s.AddImplication(1, 2); err != nil {
+			t.Fatalf("AddImplication failed: %v", err)
+		}
+		if _, err := s.AddFileTag(1, 1, 0); err != nil {
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		files, err := s.evaluate(query.TagExpression{Name: "general"})
+		if err != nil {
+			t.Fatalf("evaluate failed: %v", err)
+		}
+		if !files.Contains(1) {
+			t.Error("expected file tagged with the implying tag to match a query for the implied tag")
+		}
+	})
+}
+
+func TestKVStorageEvaluateAndOrNot(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if err := s.SetTagName(1, "a"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if err := s.SetTagName(2, "b"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if _, err := s.AddFileTag(1, 1, 0); err != nil { // file 1: a
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+		if _, err := s.AddFileTag(2, 1, 0); err != nil { // file 2: a, b
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+		if _, err := s.AddFileTag(2, 2, 0); err != nil {
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+		if _, err := s.AddFileTag(3, 2, 0); err != nil { // file 3: b
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		and := query.AndExpression{LeftOperand: query.TagExpression{Name: "a"}, RightOperand: query.TagExpression{Name: "b"}}
+		files, err := s.evaluate(and)
+		if err != nil {
+			t.Fatalf("evaluate(and) failed: %v", err)
+		}
+		if files.GetCardinality() != 1 || !files.Contains(2) {
+			t.Errorf("expected 'a and b' to match only file 2, got: %v", files.ToArray())
+		}
+
+		or := query.OrExpression{LeftOperand: query.TagExpression{Name: "a"}, RightOperand: query.TagExpression{Name: "b"}}
+		files, err = s.evaluate(or)
+		if err != nil {
+			t.Fatalf("evaluate(or) failed: %v", err)
+		}
+		if files.GetCardinality() != 3 {
+			t.Errorf("expected 'a or b' to match all three files, got: %v", files.ToArray())
+		}
+
+		not := query.NotExpression{Operand: query.TagExpression{Name: "a"}}
+		files, err = s.evaluate(not)
+		if err != nil {
+			t.Fatalf("evaluate(not) failed: %v", err)
+		}
+		if files.GetCardinality() != 1 || !files.Contains(3) {
+			t.Errorf("expected 'not a' to match only file 3, got: %v", files.ToArray())
+		}
+	})
+}
+
+func TestKVStorageEvaluateComparisonEqualsAndNotEquals(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if err := s.SetTagName(1, "colour"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if err := s.SetValueName(1, "red"); err != nil {
+			t.Fatalf("SetValueName failed: %v", err)
+		}
+		if err := s.SetValueName(2, "blue"); err != nil {
+			t.Fatalf("SetValueName failed: %v", err)
+		}
+		if _, err := s.AddFileTag(1, 1, 1); err != nil { // file 1: colour=red
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+		if _, err := s.AddFileTag(2, 1, 2); err != nil { // file 2: colour=blue
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		eq := query.ComparisonExpression{Tag: query.Tag{Name: "colour"}, Operator: "==", Value: query.Value{Name: "red"}}
+		files, err := s.evaluate(eq)
+		if err != nil {
+			t.Fatalf("evaluate(==) failed: %v", err)
+		}
+		if files.GetCardinality() != 1 || !files.Contains(1) {
+			t.Errorf("expected 'colour == red' to match only file 1, got: %v", files.ToArray())
+		}
+
+		neq := query.ComparisonExpression{Tag: query.Tag{Name: "colour"}, Operator: "!=", Value: query.Value{Name: "red"}}
+		files, err = s.evaluate(neq)
+		if err != nil {
+			t.Fatalf("evaluate(!=) failed: %v", err)
+		}
+		if files.GetCardinality() != 1 || !files.Contains(2) {
+			t.Errorf("expected 'colour != red' to match only file 2, got: %v", files.ToArray())
+		}
+	})
+}
+
+func TestKVStorageEvaluateComparisonOrderingIsNumeric(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if err := s.SetTagName(1, "size"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if err := s.SetValueName(1, "9"); err != nil {
+			t.Fatalf("SetValueName failed: %v", err)
+		}
+		if err := s.SetValueName(2, "10"); err != nil {
+			t.Fatalf("SetValueName failed: %v", err)
+		}
+		if _, err := s.AddFileTag(1, 1, 1); err != nil { // file 1: size=9
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+		if _, err := s.AddFileTag(2, 1, 2); err != nil { // file 2: size=10
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		gt := query.ComparisonExpression{Tag: query.Tag{Name: "size"}, Operator: ">", Value: query.Value{Name: "9"}}
+		files, err := s.evaluate(gt)
+		if err != nil {
+			t.Fatalf("evaluate(>) failed: %v", err)
+		}
+		// A lexicographic comparison would wrongly exclude "10" here, since
+		// the string "10" sorts before "9".
+		if files.GetCardinality() != 1 || !files.Contains(2) {
+			t.Errorf("expected 'size > 9' to compare numerically and match only file 2, got: %v", files.ToArray())
+		}
+	})
+}
+
+func TestKVStorageFileTagsForQueryResolvesNames(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if err := s.SetTagName(1, "colour"); err != nil {
+			t.Fatalf("SetTagName failed: %v", err)
+		}
+		if err := s.SetValueName(1, "red"); err != nil {
+			t.Fatalf("SetValueName failed: %v", err)
+		}
+		if _, err := s.AddFileTag(1, 1, 1); err != nil {
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		pairs, err := s.FileTagsForQuery(query.TagExpression{Name: "colour"})
+		if err != nil {
+			t.Fatalf("FileTagsForQuery failed: %v", err)
+		}
+		if len(pairs) != 1 {
+			t.Fatalf("expected 1 pair, got: %d", len(pairs))
+		}
+		if pairs[0].Tag.Name != "colour" || pairs[0].Value.Name != "red" {
+			t.Errorf("expected pair (colour, red), got: (%s, %s)", pairs[0].Tag.Name, pairs[0].Value.Name)
+		}
+	})
+}
+
+func TestKVStorageDeleteFileTagsByTagIdRemovesAllValues(t *testing.T) {
+	withKVStorage(t, func(s *KVStorage) {
+		if _, err := s.AddFileTag(1, 1, 1); err != nil {
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+		if _, err := s.AddFileTag(2, 1, 2); err != nil {
+			t.Fatalf("AddFileTag failed: %v", err)
+		}
+
+		if err := s.DeleteFileTagsByTagId(1); err != nil {
+			t.Fatalf("DeleteFileTagsByTagId failed: %v", err)
+		}
+
+		fileTags, err := s.FileTagsByTagId(1)
+		if err != nil {
+			t.Fatalf("FileTagsByTagId failed: %v", err)
+		}
+		if len(fileTags) != 0 {
+			t.Errorf("expected no file tags left for the deleted tag, got: %d", len(fileTags))
+		}
+	})
+}
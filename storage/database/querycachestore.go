@@ -0,0 +1,301 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"encoding/json"
+	"github.com/oniony/TMSU/entities"
+)
+
+// queryCacheRow is the persisted representation of a cached query result,
+// stored in the 'query_cache' sidecar table.
+type queryCacheRow struct {
+	pairs    entities.TagValuePairs
+	tagIds   map[entities.TagId]struct{}
+	valueIds map[entities.ValueId]struct{}
+}
+
+// ensureQueryCacheTable creates the 'query_cache' sidecar table and its
+// reverse-index junction tables the first time they are needed. It is
+// idempotent, so it is safe to call before every access to the tables.
+//
+// The junction tables, 'query_cache_tags' and 'query_cache_values', let
+// 'invalidateTag'/'invalidateValue' find every cache entry that depends on a
+// given tag or value by querying the database directly, rather than relying
+// on an in-process reverse index: TMSU runs as a one-shot-per-invocation CLI,
+// so an in-memory index built up during the current process can never know
+// about entries written by a previous invocation.
+func ensureQueryCacheTable(tx *Tx) error {
+	sql := `
+CREATE TABLE IF NOT EXISTS query_cache (
+    cache_key TEXT PRIMARY KEY,
+    pairs TEXT NOT NULL,
+    tag_ids TEXT NOT NULL,
+    value_ids TEXT NOT NULL
+)`
+
+	if _, err := tx.Exec(sql); err != nil {
+		return err
+	}
+
+	sql = `
+CREATE TABLE IF NOT EXISTS query_cache_tags (
+    cache_key TEXT NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (cache_key, tag_id)
+)`
+
+	if _, err := tx.Exec(sql); err != nil {
+		return err
+	}
+
+	sql = `
+CREATE INDEX IF NOT EXISTS idx_query_cache_tags_tag_id ON query_cache_tags (tag_id)`
+
+	if _, err := tx.Exec(sql); err != nil {
+		return err
+	}
+
+	sql = `
+CREATE TABLE IF NOT EXISTS query_cache_values (
+    cache_key TEXT NOT NULL,
+    value_id INTEGER NOT NULL,
+    PRIMARY KEY (cache_key, value_id)
+)`
+
+	if _, err := tx.Exec(sql); err != nil {
+		return err
+	}
+
+	sql = `
+CREATE INDEX IF NOT EXISTS idx_query_cache_values_value_id ON query_cache_values (value_id)`
+
+	_, err := tx.Exec(sql)
+	return err
+}
+
+// readQueryCacheRow loads a previously persisted cache entry, if one exists.
+func readQueryCacheRow(tx *Tx, key string) (*queryCacheRow, bool, error) {
+	if err := ensureQueryCacheTable(tx); err != nil {
+		return nil, false, err
+	}
+
+	sql := `
+SELECT pairs, tag_ids, value_ids
+FROM query_cache
+WHERE cache_key = ?1`
+
+	rows, err := tx.Query(sql, key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, nil
+	}
+	if rows.Err() != nil {
+		return nil, false, rows.Err()
+	}
+
+	var pairsJson, tagIdsJson, valueIdsJson string
+	if err := rows.Scan(&pairsJson, &tagIdsJson, &valueIdsJson); err != nil {
+		return nil, false, err
+	}
+
+	var pairs entities.TagValuePairs
+	if err := json.Unmarshal([]byte(pairsJson), &pairs); err != nil {
+		return nil, false, err
+	}
+
+	var tagIdList []entities.TagId
+	if err := json.Unmarshal([]byte(tagIdsJson), &tagIdList); err != nil {
+		return nil, false, err
+	}
+	tagIds := make(map[entities.TagId]struct{}, len(tagIdList))
+	for _, tagId := range tagIdList {
+		tagIds[tagId] = struct{}{}
+	}
+
+	var valueIdList []entities.ValueId
+	if err := json.Unmarshal([]byte(valueIdsJson), &valueIdList); err != nil {
+		return nil, false, err
+	}
+	valueIds := make(map[entities.ValueId]struct{}, len(valueIdList))
+	for _, valueId := range valueIdList {
+		valueIds[valueId] = struct{}{}
+	}
+
+	return &queryCacheRow{pairs, tagIds, valueIds}, true, nil
+}
+
+// writeQueryCacheRow persists a cache entry, replacing any existing row for
+// the same key.
+func writeQueryCacheRow(tx *Tx, key string, pairs entities.TagValuePairs, tagIds map[entities.TagId]struct{}, valueIds map[entities.ValueId]struct{}) error {
+	if err := ensureQueryCacheTable(tx); err != nil {
+		return err
+	}
+
+	pairsJson, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+
+	tagIdList := make([]entities.TagId, 0, len(tagIds))
+	for tagId := range tagIds {
+		tagIdList = append(tagIdList, tagId)
+	}
+	tagIdsJson, err := json.Marshal(tagIdList)
+	if err != nil {
+		return err
+	}
+
+	valueIdList := make([]entities.ValueId, 0, len(valueIds))
+	for valueId := range valueIds {
+		valueIdList = append(valueIdList, valueId)
+	}
+	valueIdsJson, err := json.Marshal(valueIdList)
+	if err != nil {
+		return err
+	}
+
+	sql := `
+INSERT OR REPLACE INTO query_cache (cache_key, pairs, tag_ids, value_ids)
+VALUES (?1, ?2, ?3, ?4)`
+
+	if _, err := tx.Exec(sql, key, string(pairsJson), string(tagIdsJson), string(valueIdsJson)); err != nil {
+		return err
+	}
+
+	if err := deleteQueryCacheIndexRows(tx, key); err != nil {
+		return err
+	}
+
+	for tagId := range tagIds {
+		sql := `
+INSERT OR REPLACE INTO query_cache_tags (cache_key, tag_id)
+VALUES (?1, ?2)`
+
+		if _, err := tx.Exec(sql, key, tagId); err != nil {
+			return err
+		}
+	}
+
+	for valueId := range valueIds {
+		sql := `
+INSERT OR REPLACE INTO query_cache_values (cache_key, value_id)
+VALUES (?1, ?2)`
+
+		if _, err := tx.Exec(sql, key, valueId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteQueryCacheRow removes a persisted cache entry and its reverse-index
+// rows.
+func deleteQueryCacheRow(tx *Tx, key string) error {
+	if err := ensureQueryCacheTable(tx); err != nil {
+		return err
+	}
+
+	if err := deleteQueryCacheIndexRows(tx, key); err != nil {
+		return err
+	}
+
+	sql := `
+DELETE FROM query_cache
+WHERE cache_key = ?1`
+
+	_, err := tx.Exec(sql, key)
+	return err
+}
+
+// deleteQueryCacheIndexRows removes the reverse-index rows for a cache entry,
+// without touching the entry itself.
+func deleteQueryCacheIndexRows(tx *Tx, key string) error {
+	sql := `
+DELETE FROM query_cache_tags
+WHERE cache_key = ?1`
+
+	if _, err := tx.Exec(sql, key); err != nil {
+		return err
+	}
+
+	sql = `
+DELETE FROM query_cache_values
+WHERE cache_key = ?1`
+
+	_, err := tx.Exec(sql, key)
+	return err
+}
+
+// queryCacheKeysForTag returns the keys of every persisted cache entry that
+// depends on the specified tag.
+func queryCacheKeysForTag(tx *Tx, tagId entities.TagId) ([]string, error) {
+	if err := ensureQueryCacheTable(tx); err != nil {
+		return nil, err
+	}
+
+	sql := `
+SELECT cache_key
+FROM query_cache_tags
+WHERE tag_id = ?1`
+
+	return readQueryCacheKeys(tx, sql, tagId)
+}
+
+// queryCacheKeysForValue returns the keys of every persisted cache entry that
+// depends on the specified value.
+func queryCacheKeysForValue(tx *Tx, valueId entities.ValueId) ([]string, error) {
+	if err := ensureQueryCacheTable(tx); err != nil {
+		return nil, err
+	}
+
+	sql := `
+SELECT cache_key
+FROM query_cache_values
+WHERE value_id = ?1`
+
+	return readQueryCacheKeys(tx, sql, valueId)
+}
+
+func readQueryCacheKeys(tx *Tx, sql string, arg interface{}) ([]string, error) {
+	rows, err := tx.Query(sql, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0, 10)
+
+	for rows.Next() {
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
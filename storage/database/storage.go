@@ -0,0 +1,118 @@
+// Copyright 2011-2018 Paul Ruane.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"github.com/oniony/TMSU/entities"
+	"github.com/oniony/TMSU/query"
+)
+
+// Storage is the backend-agnostic face of the 'file_tag' data. Every mutating
+// or query method mirrors one of the free functions in 'filetag.go' or
+// 'filetagbatch.go'; the
+// SQLite implementation ('SqliteStorage') simply delegates to them, while
+// alternative backends (such as 'KVStorage') provide their own storage and
+// evaluation strategy.
+type Storage interface {
+	FileTagExists(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) (bool, error)
+	FileTagCount() (uint, error)
+	FileTags() (entities.FileTags, error)
+	FileTagsByFileId(fileId entities.FileId) (entities.FileTags, error)
+	FileTagsByTagId(tagId entities.TagId) (entities.FileTags, error)
+	FileTagsByValueId(valueId entities.ValueId) (entities.FileTags, error)
+	FileTagsForQuery(expression query.Expression) (entities.TagValuePairs, error)
+	AddFileTag(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) (*entities.FileTag, error)
+	AddFileTags(triples []FileTagTriple) ([]*entities.FileTag, error)
+	DeleteFileTag(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) error
+	DeleteFileTags(triples []FileTagTriple) ([]FileTagTriple, error)
+	DeleteFileTagsByFileId(fileId entities.FileId) error
+	DeleteFileTagsByTagId(tagId entities.TagId) error
+	DeleteFileTagsByValueId(valueId entities.ValueId) error
+	CopyFileTags(sourceTagId entities.TagId, destTagId entities.TagId) error
+}
+
+// SqliteStorage is the default 'Storage' implementation, backed by the
+// existing SQLite schema and recursive-CTE queries. It simply forwards to
+// the free functions in 'filetag.go' and 'filetagbatch.go', bound to a single
+// transaction.
+type SqliteStorage struct {
+	tx *Tx
+}
+
+// NewSqliteStorage wraps a transaction as a 'Storage'.
+func NewSqliteStorage(tx *Tx) *SqliteStorage {
+	return &SqliteStorage{tx}
+}
+
+func (s *SqliteStorage) FileTagExists(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) (bool, error) {
+	return FileTagExists(s.tx, fileId, tagId, valueId)
+}
+
+func (s *SqliteStorage) FileTagCount() (uint, error) {
+	return FileTagCount(s.tx)
+}
+
+func (s *SqliteStorage) FileTags() (entities.FileTags, error) {
+	return FileTags(s.tx)
+}
+
+func (s *SqliteStorage) FileTagsByFileId(fileId entities.FileId) (entities.FileTags, error) {
+	return FileTagsByFileId(s.tx, fileId)
+}
+
+func (s *SqliteStorage) FileTagsByTagId(tagId entities.TagId) (entities.FileTags, error) {
+	return FileTagsByTagId(s.tx, tagId)
+}
+
+func (s *SqliteStorage) FileTagsByValueId(valueId entities.ValueId) (entities.FileTags, error) {
+	return FileTagsByValueId(s.tx, valueId)
+}
+
+func (s *SqliteStorage) FileTagsForQuery(expression query.Expression) (entities.TagValuePairs, error) {
+	return FileTagsForQuery(s.tx, expression)
+}
+
+func (s *SqliteStorage) AddFileTag(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) (*entities.FileTag, error) {
+	return AddFileTag(s.tx, fileId, tagId, valueId)
+}
+
+func (s *SqliteStorage) AddFileTags(triples []FileTagTriple) ([]*entities.FileTag, error) {
+	return AddFileTags(s.tx, triples)
+}
+
+func (s *SqliteStorage) DeleteFileTag(fileId entities.FileId, tagId entities.TagId, valueId entities.ValueId) error {
+	return DeleteFileTag(s.tx, fileId, tagId, valueId)
+}
+
+func (s *SqliteStorage) DeleteFileTags(triples []FileTagTriple) ([]FileTagTriple, error) {
+	return DeleteFileTags(s.tx, triples)
+}
+
+func (s *SqliteStorage) DeleteFileTagsByFileId(fileId entities.FileId) error {
+	return DeleteFileTagsByFileId(s.tx, fileId)
+}
+
+func (s *SqliteStorage) DeleteFileTagsByTagId(tagId entities.TagId) error {
+	return DeleteFileTagsByTagId(s.tx, tagId)
+}
+
+func (s *SqliteStorage) DeleteFileTagsByValueId(valueId entities.ValueId) error {
+	return DeleteFileTagsByValueId(s.tx, valueId)
+}
+
+func (s *SqliteStorage) CopyFileTags(sourceTagId entities.TagId, destTagId entities.TagId) error {
+	return CopyFileTags(s.tx, sourceTagId, destTagId)
+}